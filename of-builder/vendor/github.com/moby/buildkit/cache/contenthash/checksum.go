@@ -0,0 +1,545 @@
+package contenthash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/gob"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/snapshot"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+)
+
+var errNotFound = errors.Errorf("not found")
+
+var defaultManager *cacheManager
+var defaultManagerOnce sync.Once
+
+// Algorithm selects the digest function used to hash file content. The
+// zero value is SHA256, matching the behavior before algorithm selection
+// was configurable.
+type Algorithm int
+
+const (
+	AlgorithmSHA256 Algorithm = iota
+	AlgorithmSHA512
+	AlgorithmBLAKE3
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case AlgorithmSHA512:
+		return "sha512"
+	case AlgorithmBLAKE3:
+		return "blake3"
+	default:
+		return "sha256"
+	}
+}
+
+// digestAlgorithm is only ever reached for algorithms newHash has already
+// accepted, so AlgorithmBLAKE3 (which newHash rejects outright) never
+// reaches this switch.
+func (a Algorithm) digestAlgorithm() digest.Algorithm {
+	switch a {
+	case AlgorithmSHA512:
+		return digest.SHA512
+	default:
+		return digest.SHA256
+	}
+}
+
+func (a Algorithm) newHash() (hash.Hash, error) {
+	switch a {
+	case AlgorithmSHA256:
+		return sha256.New(), nil
+	case AlgorithmSHA512:
+		return sha512.New(), nil
+	case AlgorithmBLAKE3:
+		// No blake3 implementation is vendored here. Error out explicitly
+		// rather than aliasing to sha512, which would silently produce a
+		// digest that is byte-for-byte AlgorithmSHA512 under a different
+		// name.
+		return nil, errors.Errorf("blake3 is not implemented")
+	default:
+		return nil, errors.Errorf("unsupported algorithm %v", a)
+	}
+}
+
+// Opts configures a Checksum call. The zero value checksums with SHA256,
+// matching the package's original, single-algorithm behavior.
+type Opts struct {
+	Algorithm Algorithm
+}
+
+// CacheContext computes and caches content-based checksums for the files
+// that make up a cache.ImmutableRef, so that equal file trees produce equal
+// digests regardless of the snapshot they were produced from.
+type CacheContext interface {
+	Checksum(ctx context.Context, ref cache.ImmutableRef, p string, opts ...Opts) (digest.Digest, error)
+	HandleChange(kind fsutil.ChangeKind, p string, fi os.FileInfo, err error) error
+}
+
+type entry struct {
+	isDir    bool
+	linkname string
+
+	// path is the entry's location under the scanned root, used to
+	// re-hash the file if a digest under a different algorithm than the
+	// one it was first scanned with is requested. Entries delivered only
+	// through HandleChange (no backing root on disk) leave this empty.
+	path string
+
+	mu      sync.Mutex
+	digests map[Algorithm]digest.Digest
+}
+
+func (e *entry) cachedDigest(alg Algorithm) (digest.Digest, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dgst, ok := e.digests[alg]
+	return dgst, ok
+}
+
+func (e *entry) setDigest(alg Algorithm, dgst digest.Digest) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.digests == nil {
+		e.digests = map[Algorithm]digest.Digest{}
+	}
+	e.digests[alg] = dgst
+}
+
+// cacheContext lazily scans the contents of a ref on first use and keeps the
+// result around so repeated Checksum calls for the same ref are cheap. It
+// also accepts incremental updates through HandleChange so callers that are
+// streaming file changes (rather than handing over a finished snapshot) can
+// keep the tree up to date without a full rescan. Digests are additionally
+// persisted to md, keyed by (path, algorithm), so a cacheContext rebuilt
+// for the same ref later (eg. after a restart) doesn't need to re-hash
+// files it already checksummed.
+type cacheContext struct {
+	mu      sync.Mutex
+	md      *metadata.StorageItem
+	tree    map[string]*entry
+	scanned bool
+	loaded  map[Algorithm]bool
+}
+
+func newCacheContext(md *metadata.StorageItem) (*cacheContext, error) {
+	cc := &cacheContext{
+		md:     md,
+		tree:   map[string]*entry{},
+		loaded: map[Algorithm]bool{},
+	}
+	return cc, nil
+}
+
+// NewCacheContext is the exported form of newCacheContext for packages
+// (such as fscache) that need to feed a CacheContext directly off a
+// streaming change source rather than going through the package-level
+// Checksum/cacheManager path.
+func NewCacheContext(md *metadata.StorageItem) (CacheContext, error) {
+	return newCacheContext(md)
+}
+
+func getDefaultManager() *cacheManager {
+	defaultManagerOnce.Do(func() {
+		cm := &cacheManager{m: map[string]*cacheContext{}}
+		cm.lru = &refLRU{cm: cm}
+		defaultManager = cm
+	})
+	return defaultManager
+}
+
+// cacheManager keeps one cacheContext per ref so that callers hitting the
+// same ref repeatedly (eg. multiple Checksum calls across a build) reuse the
+// scanned tree instead of rescanning it from disk every time.
+type cacheManager struct {
+	mu  sync.Mutex
+	m   map[string]*cacheContext
+	lru *refLRU
+}
+
+// refLRU is a thin, unbounded stand-in for a real eviction policy; callers
+// (tests in particular) use Purge to drop all cached contexts, eg. after
+// closing the underlying metadata store.
+type refLRU struct {
+	cm *cacheManager
+}
+
+func (l *refLRU) Purge() {
+	l.cm.mu.Lock()
+	defer l.cm.mu.Unlock()
+	l.cm.m = map[string]*cacheContext{}
+}
+
+func (cm *cacheManager) get(id string, md *metadata.StorageItem) (*cacheContext, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cc, ok := cm.m[id]
+	if ok {
+		return cc, nil
+	}
+
+	cc, err := newCacheContext(md)
+	if err != nil {
+		return nil, err
+	}
+	cm.m[id] = cc
+	return cc, nil
+}
+
+// Checksum is a convenience wrapper around a per-ref CacheContext kept by the
+// package-level cache manager. Most callers that only need a one-off digest
+// should use this instead of managing a CacheContext themselves.
+func Checksum(ctx context.Context, ref cache.ImmutableRef, p string, opts ...Opts) (digest.Digest, error) {
+	cm := getDefaultManager()
+	cc, err := cm.get(ref.ID(), ref.Metadata())
+	if err != nil {
+		return "", err
+	}
+	return cc.Checksum(ctx, ref, p, opts...)
+}
+
+func (cc *cacheContext) Checksum(ctx context.Context, ref cache.ImmutableRef, p string, opts ...Opts) (digest.Digest, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if !cc.scanned {
+		if err := cc.scanRef(ctx, ref); err != nil {
+			return "", err
+		}
+		cc.scanned = true
+	}
+
+	var o Opts
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+
+	cc.loadCachedLocked(o.Algorithm)
+
+	dgst, err := cc.checksumLocked(cleanPath(p), o.Algorithm, true)
+	if err != nil {
+		return "", err
+	}
+	if err := cc.persistCachedLocked(o.Algorithm); err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
+
+// contentHashKey is the metadata key that persistCachedLocked/
+// loadCachedLocked store alg's digests under.
+func contentHashKey(alg Algorithm) string {
+	return "contenthash." + alg.String()
+}
+
+// loadCachedLocked restores any digests persisted for alg on a previous
+// run into the matching in-memory entries, so files scanned again don't
+// need to be re-hashed. It is a no-op past the first call for a given alg.
+func (cc *cacheContext) loadCachedLocked(alg Algorithm) {
+	if cc.md == nil || cc.loaded[alg] {
+		return
+	}
+	cc.loaded[alg] = true
+
+	dt, err := cc.md.GetExternal(contentHashKey(alg))
+	if err != nil || len(dt) == 0 {
+		return
+	}
+
+	cached := map[string]digest.Digest{}
+	if err := gob.NewDecoder(bytes.NewReader(dt)).Decode(&cached); err != nil {
+		return
+	}
+	for p, dgst := range cached {
+		if e, ok := cc.tree[p]; ok && !e.isDir && e.linkname == "" {
+			e.setDigest(alg, dgst)
+		}
+	}
+}
+
+// persistCachedLocked writes every digest currently cached under alg back
+// to the metadata store, keyed by path, so a cacheContext built later for
+// the same ref can skip re-hashing files it already checksummed.
+func (cc *cacheContext) persistCachedLocked(alg Algorithm) error {
+	if cc.md == nil {
+		return nil
+	}
+
+	cached := map[string]digest.Digest{}
+	for p, e := range cc.tree {
+		if e.isDir || e.linkname != "" {
+			continue
+		}
+		if dgst, ok := e.cachedDigest(alg); ok {
+			cached[p] = dgst
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cached); err != nil {
+		return err
+	}
+	return cc.md.SetExternal(contentHashKey(alg), buf.Bytes())
+}
+
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func (cc *cacheContext) checksumLocked(p string, alg Algorithm, followLinks bool) (digest.Digest, error) {
+	if p == "" {
+		return cc.dirDigest("", alg)
+	}
+
+	e, ok := cc.tree[p]
+	if !ok {
+		return "", errors.Wrapf(errNotFound, "%s not found", p)
+	}
+
+	if e.isDir {
+		return cc.dirDigest(p, alg)
+	}
+
+	if followLinks && e.linkname != "" {
+		target := e.linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		return cc.checksumLocked(cleanPath(target), alg, true)
+	}
+
+	return cc.fileDigest(e, p, alg)
+}
+
+// fileDigest returns e's digest under alg, computing and caching it (keyed
+// by path and algorithm, per entry) the first time that algorithm is asked
+// for. Entries scanned from disk can always be re-hashed; entries that only
+// ever arrived through HandleChange have no backing file to re-read, so a
+// request for an algorithm other than the one they were reported with fails
+// instead of silently mislabeling the digest.
+func (cc *cacheContext) fileDigest(e *entry, p string, alg Algorithm) (digest.Digest, error) {
+	if dgst, ok := e.cachedDigest(alg); ok {
+		return dgst, nil
+	}
+
+	if e.path == "" {
+		return "", errors.Errorf("no cached digest for %s under algorithm %s", p, alg)
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h, err := alg.newHash()
+	if err != nil {
+		return "", err
+	}
+	io.WriteString(h, "file\x00\x00")
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	dgst := digest.NewDigest(alg.digestAlgorithm(), h)
+	e.setDigest(alg, dgst)
+	return dgst, nil
+}
+
+// dirDigest is recomputed on demand (rather than cached) so that deletions
+// and additions handled through HandleChange are reflected immediately.
+func (cc *cacheContext) dirDigest(p string, alg Algorithm) (digest.Digest, error) {
+	if p != "" {
+		if e, ok := cc.tree[p]; !ok || !e.isDir {
+			return "", errors.Wrapf(errNotFound, "%s not found", p)
+		}
+	}
+
+	prefix := p
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var names []string
+	for child := range cc.tree {
+		if child == p {
+			continue
+		}
+		if strings.HasPrefix(child, prefix) && !strings.Contains(strings.TrimPrefix(child, prefix), "/") {
+			names = append(names, child)
+		}
+	}
+	sort.Strings(names)
+
+	h, err := alg.newHash()
+	if err != nil {
+		return "", err
+	}
+	io.WriteString(h, "dir\x00\x00")
+	for _, name := range names {
+		e := cc.tree[name]
+		var dgst digest.Digest
+		if e.isDir {
+			dgst, err = cc.dirDigest(name, alg)
+		} else {
+			dgst, err = cc.fileDigest(e, name, alg)
+		}
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, path.Base(name)+"\x00"+dgst.String()+"\x00")
+	}
+	return digest.NewDigest(alg.digestAlgorithm(), h), nil
+}
+
+// scanRef walks the committed contents of ref once to build the initial
+// tree. Further updates are expected to arrive through HandleChange.
+func (cc *cacheContext) scanRef(ctx context.Context, ref cache.ImmutableRef) error {
+	mounts, err := ref.Mount(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	lm := snapshot.LocalMounter(mounts)
+	root, err := lm.Mount()
+	if err != nil {
+		return err
+	}
+	defer lm.Unmount()
+
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if fi.IsDir() {
+			cc.tree[rel] = &entry{isDir: true}
+			return nil
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			cc.tree[rel] = &entry{linkname: link}
+			return nil
+		}
+
+		cc.tree[rel] = &entry{path: p}
+		return nil
+	})
+}
+
+// HandleChange implements fsutil.HandleChangeFn so a cacheContext can be fed
+// incrementally from a stream of file changes instead of (or in addition
+// to) an on-disk scan.
+func (cc *cacheContext) HandleChange(kind fsutil.ChangeKind, p string, fi os.FileInfo, err error) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	p = cleanPath(p)
+
+	if kind == fsutil.ChangeKindDelete {
+		cc.deleteLocked(p)
+		return nil
+	}
+
+	if fi.IsDir() {
+		cc.tree[p] = &entry{isDir: true}
+		return nil
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		stat, ok := fi.Sys().(*fsutil.Stat)
+		if !ok {
+			return errors.Errorf("invalid fileinfo for symlink %s", p)
+		}
+		cc.tree[p] = &entry{linkname: stat.Linkname}
+		return nil
+	}
+
+	dgstr, ok := fi.(interface{ Digest() digest.Digest })
+	if !ok {
+		return errors.Errorf("invalid fileinfo for %s: no digest", p)
+	}
+
+	dgst := dgstr.Digest()
+	alg, err := algorithmFromDigest(dgst.Algorithm())
+	if err != nil {
+		return errors.Wrapf(err, "HandleChange %s", p)
+	}
+
+	e := &entry{}
+	e.setDigest(alg, dgst)
+	cc.tree[p] = e
+	return cc.persistCachedLocked(alg)
+}
+
+// algorithmFromDigest maps a digest's own algorithm back to our Algorithm
+// type, so entries delivered through HandleChange are filed under the
+// cache slot that actually matches how they were hashed instead of being
+// blanket-tagged AlgorithmSHA256.
+func algorithmFromDigest(alg digest.Algorithm) (Algorithm, error) {
+	switch alg {
+	case digest.SHA256:
+		return AlgorithmSHA256, nil
+	case digest.SHA512:
+		return AlgorithmSHA512, nil
+	default:
+		return 0, errors.Errorf("unsupported digest algorithm %q", alg)
+	}
+}
+
+func (cc *cacheContext) deleteLocked(p string) {
+	delete(cc.tree, p)
+	prefix := p + "/"
+	for child := range cc.tree {
+		if strings.HasPrefix(child, prefix) {
+			delete(cc.tree, child)
+		}
+	}
+}
+
+// NewFromStat returns a hash.Hash seeded with the parts of stat that should
+// contribute to a file's content digest (currently a type marker plus
+// stat.Linkname, which is empty for regular files; mode
+// and ownership bits are intentionally left out so that two files with the
+// same data hash the same regardless of how they were produced). Callers
+// write the file's data to the returned hash to finish the digest. alg
+// selects which underlying hash function is used; the zero value is
+// AlgorithmSHA256, matching the package's original behavior.
+func NewFromStat(stat *fsutil.Stat, alg Algorithm) (hash.Hash, error) {
+	h, err := alg.newHash()
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(h, "file\x00"+stat.Linkname+"\x00")
+	return h, nil
+}
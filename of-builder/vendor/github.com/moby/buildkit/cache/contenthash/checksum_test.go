@@ -175,6 +175,96 @@ func TestChecksumBasicFile(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestChecksumAlgorithms(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "buildkit-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	cm := setupCacheManager(t, tmpdir)
+	defer cm.Close()
+
+	ch := []string{
+		"ADD foo file data0",
+		"ADD d0 dir",
+		"ADD d0/abc file data0",
+	}
+
+	ref := createRef(t, cm, ch)
+	defer ref.Release(context.TODO())
+
+	cc, err := newCacheContext(ref.Metadata())
+	require.NoError(t, err)
+
+	for _, alg := range []Algorithm{AlgorithmSHA256, AlgorithmSHA512} {
+		dgst, err := cc.Checksum(context.TODO(), ref, "foo", Opts{Algorithm: alg})
+		assert.NoError(t, err)
+		assert.Equal(t, alg.digestAlgorithm(), dgst.Algorithm())
+
+		// re-checksumming under a different algorithm doesn't disturb the
+		// digest already cached for the first one
+		dgstAgain, err := cc.Checksum(context.TODO(), ref, "foo", Opts{Algorithm: AlgorithmSHA256})
+		assert.NoError(t, err)
+		assert.Equal(t, digest.SHA256, dgstAgain.Algorithm())
+	}
+
+	// directory digests are also algorithm-specific
+	dgstDir256, err := cc.Checksum(context.TODO(), ref, "d0", Opts{Algorithm: AlgorithmSHA256})
+	assert.NoError(t, err)
+	dgstDir512, err := cc.Checksum(context.TODO(), ref, "d0", Opts{Algorithm: AlgorithmSHA512})
+	assert.NoError(t, err)
+	assert.NotEqual(t, dgstDir256, dgstDir512)
+
+	// omitting Opts keeps the original, SHA256-only behavior
+	dgstDefault, err := cc.Checksum(context.TODO(), ref, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, digest.SHA256, dgstDefault.Algorithm())
+
+	// AlgorithmBLAKE3 has no backing implementation vendored here; it must
+	// error rather than silently alias to sha512
+	_, err = cc.Checksum(context.TODO(), ref, "foo", Opts{Algorithm: AlgorithmBLAKE3})
+	assert.Error(t, err)
+}
+
+func TestHandleChangeAlgorithm(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "buildkit-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	cm := setupCacheManager(t, tmpdir)
+	defer cm.Close()
+
+	ref := createRef(t, cm, nil)
+	defer ref.Release(context.TODO())
+
+	cc, err := newCacheContext(ref.Metadata())
+	require.NoError(t, err)
+
+	c := parseChange("ADD foo file data0")
+	stat := c.fi.Sys().(*fsutil.Stat)
+
+	h, err := NewFromStat(stat, AlgorithmSHA512)
+	require.NoError(t, err)
+	_, err = io.Copy(h, strings.NewReader(c.data))
+	require.NoError(t, err)
+	fi := &withHash{FileInfo: c.fi, digest: digest.NewDigest(digest.SHA512, h)}
+
+	err = cc.HandleChange(c.kind, c.path, fi, nil)
+	require.NoError(t, err)
+
+	// the entry must be filed under the algorithm the digest actually came
+	// from, not hard-coded to SHA256
+	dgst, err := cc.Checksum(context.TODO(), ref, "foo", Opts{Algorithm: AlgorithmSHA512})
+	assert.NoError(t, err)
+	assert.Equal(t, digest.SHA512, dgst.Algorithm())
+	assert.Equal(t, fi.digest, dgst)
+
+	// asking for SHA256 on an entry that only ever arrived as SHA512
+	// through HandleChange must fail rather than return a mislabeled
+	// digest
+	_, err = cc.Checksum(context.TODO(), ref, "foo", Opts{Algorithm: AlgorithmSHA256})
+	assert.Error(t, err)
+}
+
 func TestHandleChange(t *testing.T) {
 	tmpdir, err := ioutil.TempDir("", "buildkit-state")
 	require.NoError(t, err)
@@ -410,7 +500,7 @@ func emit(fn fsutil.HandleChangeFn, inp []*change) error {
 		}
 		fi := c.fi
 		if c.kind != fsutil.ChangeKindDelete {
-			h, err := NewFromStat(stat)
+			h, err := NewFromStat(stat, AlgorithmSHA256)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,103 @@
+package fscache
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+)
+
+// applyChange mirrors a single streamed delta onto the session's naive
+// working directory. It is intentionally dumb (no rename detection, no
+// partial-write staging) since the session already owns an exclusive
+// scratch tree and the sender is expected to resend a file in full on
+// ADD/CHG.
+//
+// p and (for symlinks) the link target both come straight off the wire
+// from a client session and are checked before either ever reaches the
+// filesystem. p is clamped into a root-relative path (so a delta like
+// p = "../../etc/x" lands inside root rather than erroring) since we
+// choose dest ourselves and only ever write there directly. A symlink's
+// target is instead rejected outright if it would resolve outside root,
+// since it is written to disk byte-for-byte and later resolved by the OS
+// relative to its own directory, not through our path-clamping logic.
+func applyChange(root string, kind fsutil.ChangeKind, p string, fi os.FileInfo) error {
+	dest, err := safeJoin(root, p)
+	if err != nil {
+		return err
+	}
+
+	if kind == fsutil.ChangeKindDelete {
+		return os.RemoveAll(dest)
+	}
+
+	if fi.IsDir() {
+		return os.MkdirAll(dest, fi.Mode().Perm())
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		stat, ok := fi.Sys().(*fsutil.Stat)
+		if !ok {
+			return errors.Errorf("invalid fileinfo for symlink %s", p)
+		}
+		if filepath.IsAbs(stat.Linkname) {
+			return errors.Errorf("symlink %s has absolute target %q, refusing", p, stat.Linkname)
+		}
+		if symlinkEscapesRoot(cleanRel(p), filepath.ToSlash(stat.Linkname)) {
+			return errors.Errorf("symlink %s has target %q outside of the session root", p, stat.Linkname)
+		}
+		os.Remove(dest)
+		return os.Symlink(stat.Linkname, dest)
+	}
+
+	// Regular file content is expected to have already been written to
+	// dest by the caller as bytes arrived; HandleChange only needs to
+	// record the final fsutil.Stat for checksumming.
+	if _, err := os.Stat(dest); err != nil {
+		return errors.Wrapf(err, "missing file content for %s", p)
+	}
+	return nil
+}
+
+// cleanRel mirrors contenthash's cleanPath: it collapses ".."/"." segments
+// the same way, rooted at "/", then strips the leading slash. Rooting the
+// clean at "/" means any ".." that would otherwise climb above root is
+// dropped instead of escaping, so the relative path it returns is always
+// safe to join onto root directly.
+func cleanRel(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// symlinkEscapesRoot reports whether target, if written as the literal
+// contents of a symlink at rel (the symlink's own cleaned, root-relative
+// path), would resolve outside root once the OS follows it.
+//
+// This deliberately does NOT use cleanRel's root-rooted clean: the link is
+// written to disk with its target byte-for-byte as given, and the OS
+// resolves it relative to its own containing directory later, not through
+// our path.Clean("/"+p) semantics. Rooting the join at "/" the way cleanRel
+// does would silently clamp an escaping target back inside root for the
+// purposes of this check while the symlink on disk still points wherever
+// it originally did, approving exactly the escape this guard exists to
+// catch.
+func symlinkEscapesRoot(rel, target string) bool {
+	joined := path.Join(path.Dir(rel), target)
+	return joined == ".." || strings.HasPrefix(joined, "../")
+}
+
+// safeJoin cleans p the same way cleanRel does and joins it onto root.
+// Since cleanRel drops any ".." that would climb above root, a path such as
+// "../../x" is clamped to root/x rather than rejected; the prefix check
+// below only rejects a result that still does not lie under root.
+func safeJoin(root, p string) (string, error) {
+	rel := cleanRel(p)
+	dest := filepath.Join(root, filepath.FromSlash(rel))
+
+	if dest != root && !strings.HasPrefix(dest, root+string(filepath.Separator)) {
+		return "", errors.Errorf("path %q escapes session root", p)
+	}
+	return dest, nil
+}
@@ -0,0 +1,104 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+)
+
+func TestSafeJoinClampsTraversal(t *testing.T) {
+	root, err := ioutil.TempDir("", "fscache-safejoin")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// p itself is never trusted to point where it says: it is clamped to a
+	// path under root rather than rejected, since safeJoin is the one
+	// choosing dest and never resolves it through the OS the way a symlink
+	// target would be.
+	dest, err := safeJoin(root, "../../../etc/cron.d/x")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(dest, root+string(filepath.Separator)))
+}
+
+func TestSafeJoinAllowsNested(t *testing.T) {
+	root, err := ioutil.TempDir("", "fscache-safejoin")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	dest, err := safeJoin(root, "a/b/c")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "a", "b", "c"), dest)
+}
+
+func TestSymlinkEscapesRoot(t *testing.T) {
+	assert.True(t, symlinkEscapesRoot("link", "../../../../etc/passwd"))
+	assert.True(t, symlinkEscapesRoot("sub/link", "../../../../etc/passwd"))
+	assert.False(t, symlinkEscapesRoot("sub/link", "../etc/passwd"))
+	assert.False(t, symlinkEscapesRoot("sub/link", "../d0"))
+}
+
+func dirInfo() os.FileInfo {
+	return &fsutil.StatInfo{Stat: &fsutil.Stat{Mode: uint32(os.ModeDir) | 0700}}
+}
+
+func symlinkInfo(target string) os.FileInfo {
+	return &fsutil.StatInfo{Stat: &fsutil.Stat{Mode: uint32(os.ModeSymlink) | 0777, Linkname: target}}
+}
+
+func TestApplyChangeClampsPathTraversal(t *testing.T) {
+	root, err := ioutil.TempDir("", "fscache-apply")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	err = applyChange(root, fsutil.ChangeKindAdd, "../../../etc/cron.d", dirInfo())
+	assert.NoError(t, err)
+
+	// the delta lands inside root at its clamped path, not above it
+	_, statErr := os.Stat(filepath.Join(root, "etc", "cron.d"))
+	assert.NoError(t, statErr)
+	_, statErr = os.Stat(filepath.Join(filepath.Dir(root), "etc"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestApplyChangeRejectsAbsoluteSymlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "fscache-apply")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	err = applyChange(root, fsutil.ChangeKindAdd, "link", symlinkInfo("/etc/passwd"))
+	assert.Error(t, err)
+
+	_, statErr := os.Lstat(filepath.Join(root, "link"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestApplyChangeRejectsSymlinkEscapingRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "fscache-apply")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	err = applyChange(root, fsutil.ChangeKindAdd, "sub/link", symlinkInfo("../../../../etc/passwd"))
+	assert.Error(t, err)
+
+	_, statErr := os.Lstat(filepath.Join(root, "sub", "link"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestApplyChangeAllowsSymlinkWithinRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "fscache-apply")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	require.NoError(t, applyChange(root, fsutil.ChangeKindAdd, "d0", dirInfo()))
+	require.NoError(t, applyChange(root, fsutil.ChangeKindAdd, "d0/link", symlinkInfo("../d0")))
+
+	target, err := os.Readlink(filepath.Join(root, "d0", "link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "../d0", target)
+}
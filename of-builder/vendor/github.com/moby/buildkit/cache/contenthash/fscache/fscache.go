@@ -0,0 +1,220 @@
+// Package fscache provides a shared, session-scoped cache of files that
+// are delivered incrementally (as fsutil.ChangeKind deltas) rather than as
+// a finished snapshot on disk. It is used by client-driven builds where the
+// local build context is synced to the daemon over a long-lived session:
+// instead of re-transferring and re-hashing the whole context on every
+// reconnect, a client that presents the same shared key reuses the scratch
+// tree it built up last time and only the delta needs to be applied and
+// checksummed.
+package fscache
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/cache/contenthash"
+	"github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/snapshot"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+)
+
+// DefaultIdleTimeout is how long a session's scratch tree is kept around
+// after its last reference is released before it becomes eligible for
+// pruning.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// Source is handed a stream of file changes for a session and incrementally
+// maintains a cache.ImmutableRef plus its content digests. It is the
+// fscache equivalent of buildkit's own incremental build context handling,
+// wired into this module's cache.Manager instead of a standalone store.
+type Source interface {
+	// SharedKey reconnects (or creates) a session's scratch tree. Reusing
+	// the same sharedKey across sessions is what allows a reconnecting
+	// client to only transfer the files that changed since last time.
+	SharedKey(ctx context.Context, sharedKey string) (*Session, error)
+	Prune(ctx context.Context, opts PruneOpts) (PruneReport, error)
+	Close() error
+}
+
+// PruneOpts filters which idle sessions Prune is allowed to free.
+type PruneOpts struct {
+	// All also removes sessions that are still within their idle timeout.
+	All bool
+}
+
+// PruneReport summarises the result of a Prune call.
+type PruneReport struct {
+	Sessions int
+	Bytes    int64
+}
+
+type source struct {
+	mu          sync.Mutex
+	cm          cache.Manager
+	md          *metadata.Store
+	idleTimeout time.Duration
+	sessions    map[string]*Session
+}
+
+// NewSource returns a Source backed by cm for scratch trees. md is kept on
+// the source but never read or written: the sharedKey -> session mapping is
+// held in memory only and does not survive a restart.
+func NewSource(cm cache.Manager, md *metadata.Store, idleTimeout time.Duration) Source {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	return &source{
+		cm:          cm,
+		md:          md,
+		idleTimeout: idleTimeout,
+		sessions:    map[string]*Session{},
+	}
+}
+
+// Session is a reference-counted, naive-snapshotter-backed working
+// directory for a single sharedKey. Changes are applied to the working
+// directory and piggy-backed onto CacheContext.HandleChange so digests are
+// computed incrementally as they arrive, mirroring the Checksum/
+// newCacheContext path used for finished refs.
+type Session struct {
+	src       *source
+	sharedKey string
+
+	mu       sync.Mutex
+	refs     int
+	mref     cache.MutableRef
+	mountDir string
+	unmount  func() error
+	cc       contenthash.CacheContext
+	idleAt   time.Time
+	closed   bool
+}
+
+func (s *source) SharedKey(ctx context.Context, sharedKey string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[sharedKey]; ok {
+		sess.mu.Lock()
+		sess.refs++
+		sess.idleAt = time.Time{}
+		sess.mu.Unlock()
+		return sess, nil
+	}
+
+	mref, err := s.cm.New(ctx, nil, cache.CachePolicyRetain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create scratch tree for %s", sharedKey)
+	}
+
+	mounts, err := mref.Mount(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	lm := snapshot.LocalMounter(mounts)
+	dir, err := lm.Mount()
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := contenthash.NewCacheContext(mref.Metadata())
+	if err != nil {
+		lm.Unmount()
+		return nil, err
+	}
+
+	sess := &Session{
+		src:       s,
+		sharedKey: sharedKey,
+		refs:      1,
+		mref:      mref,
+		mountDir:  dir,
+		unmount:   lm.Unmount,
+		cc:        cc,
+	}
+	s.sessions[sharedKey] = sess
+	return sess, nil
+}
+
+// HandleChange applies a single streamed delta to the session's working
+// directory and feeds it into the underlying CacheContext so the running
+// digest reflects it immediately.
+func (sess *Session) HandleChange(kind fsutil.ChangeKind, p string, fi os.FileInfo, err error) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.closed {
+		return errors.Errorf("session %s is closed", sess.sharedKey)
+	}
+
+	if err := applyChange(sess.mountDir, kind, p, fi); err != nil {
+		return err
+	}
+
+	return sess.cc.HandleChange(kind, p, fi, err)
+}
+
+// Ref returns the cache.ImmutableRef of the tree as it currently stands, so
+// the caller can compute checksums against it via Checksum/CacheContext.
+func (sess *Session) Ref(ctx context.Context) (cache.ImmutableRef, error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.mref.Commit(ctx)
+}
+
+// Release drops the caller's reference. The scratch tree itself stays
+// mounted and in place until Prune frees it (once the idle timeout has
+// elapsed since this release, or at once with PruneOpts.All); nothing frees
+// it on a timer. Until then a client that reconnects with the same
+// sharedKey can resume without retransferring unchanged files.
+func (sess *Session) Release() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.refs--
+	if sess.refs <= 0 {
+		sess.idleAt = time.Now()
+	}
+}
+
+// Prune releases scratch trees that have had no references for longer than
+// the configured idle timeout (or every released, unreferenced one, with
+// PruneOpts.All). Sessions still holding a reference are never pruned.
+func (s *source) Prune(ctx context.Context, opts PruneOpts) (PruneReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var report PruneReport
+	for key, sess := range s.sessions {
+		sess.mu.Lock()
+		idle := sess.refs <= 0 && !sess.idleAt.IsZero() && (opts.All || time.Now().Sub(sess.idleAt) > s.idleTimeout)
+		if idle {
+			sess.closed = true
+			if err := sess.unmount(); err != nil {
+				sess.mu.Unlock()
+				return report, err
+			}
+			if err := sess.mref.Release(ctx); err != nil {
+				sess.mu.Unlock()
+				return report, err
+			}
+			delete(s.sessions, key)
+			report.Sessions++
+		}
+		sess.mu.Unlock()
+	}
+	return report, nil
+}
+
+func (s *source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, sess := range s.sessions {
+		sess.unmount()
+		delete(s.sessions, key)
+	}
+	return nil
+}
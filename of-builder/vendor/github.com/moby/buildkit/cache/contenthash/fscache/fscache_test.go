@@ -0,0 +1,121 @@
+package fscache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/snapshot/naive"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/cache/contenthash"
+	"github.com/moby/buildkit/cache/metadata"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+)
+
+// TestSessionHandleChangeRoundTrip exercises the whole SharedKey ->
+// HandleChange -> Ref path: a file delta is applied to the session's
+// scratch tree and fed into its CacheContext, and the resulting ref's
+// checksum must match what was streamed in.
+func TestSessionHandleChangeRoundTrip(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "fscache-session")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	cm := setupCacheManager(t, tmpdir)
+	defer cm.Close()
+
+	md, err := metadata.NewStore(filepath.Join(tmpdir, "fscache-metadata.db"))
+	require.NoError(t, err)
+
+	src := NewSource(cm, md, 0)
+	defer src.Close()
+
+	ctx := context.Background()
+	sess, err := src.SharedKey(ctx, "session-a")
+	require.NoError(t, err)
+	defer sess.Release()
+
+	data := "hello world"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(sess.mountDir, "foo"), []byte(data), 0644))
+
+	stat := &fsutil.Stat{Mode: 0644, Size_: int64(len(data))}
+	h, err := contenthash.NewFromStat(stat, contenthash.AlgorithmSHA256)
+	require.NoError(t, err)
+	_, err = io.Copy(h, strings.NewReader(data))
+	require.NoError(t, err)
+	dgst := digest.NewDigest(digest.SHA256, h)
+
+	fi := &withDigest{FileInfo: &fsutil.StatInfo{Stat: stat}, digest: dgst}
+	require.NoError(t, sess.HandleChange(fsutil.ChangeKindAdd, "foo", fi, nil))
+
+	ref, err := sess.Ref(ctx)
+	require.NoError(t, err)
+	defer ref.Release(ctx)
+
+	got, err := contenthash.Checksum(ctx, ref, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, got)
+}
+
+// TestSessionHandleChangeRejectsSymlinkEscape confirms a malicious symlink
+// delta never reaches the real scratch tree: the session must surface
+// applyChange's rejection rather than writing a link that would resolve
+// outside its root.
+func TestSessionHandleChangeRejectsSymlinkEscape(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "fscache-session")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	cm := setupCacheManager(t, tmpdir)
+	defer cm.Close()
+
+	md, err := metadata.NewStore(filepath.Join(tmpdir, "fscache-metadata.db"))
+	require.NoError(t, err)
+
+	src := NewSource(cm, md, 0)
+	defer src.Close()
+
+	ctx := context.Background()
+	sess, err := src.SharedKey(ctx, "session-b")
+	require.NoError(t, err)
+	defer sess.Release()
+
+	fi := &fsutil.StatInfo{Stat: &fsutil.Stat{Mode: uint32(os.ModeSymlink) | 0777, Linkname: "../../../../etc/passwd"}}
+	err = sess.HandleChange(fsutil.ChangeKindAdd, "link", fi, nil)
+	assert.Error(t, err)
+
+	_, statErr := os.Lstat(filepath.Join(sess.mountDir, "link"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func setupCacheManager(t *testing.T, tmpdir string) cache.Manager {
+	snapshotter, err := naive.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+	require.NoError(t, err)
+
+	md, err := metadata.NewStore(filepath.Join(tmpdir, "metadata.db"))
+	require.NoError(t, err)
+
+	cm, err := cache.NewManager(cache.ManagerOpt{
+		Snapshotter:   snapshotter,
+		MetadataStore: md,
+	})
+	require.NoError(t, err)
+
+	return cm
+}
+
+type withDigest struct {
+	os.FileInfo
+	digest digest.Digest
+}
+
+func (w *withDigest) Digest() digest.Digest {
+	return w.digest
+}
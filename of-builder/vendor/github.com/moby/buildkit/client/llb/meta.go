@@ -1,9 +1,14 @@
 package llb
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
 
 	"github.com/google/shlex"
+	"github.com/pkg/errors"
 )
 
 type contextKeyT string
@@ -33,6 +38,58 @@ func delEnv(key string) StateOption {
 	}
 }
 
+// AddEnvFromMap returns a StateOption that adds every entry of m to the
+// state's environment, in key-sorted order so the resulting EnvList (and
+// therefore any cache key derived from it) is deterministic regardless of
+// Go's map iteration order.
+func AddEnvFromMap(m map[string]string) StateOption {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return func(s State) State {
+		for _, k := range keys {
+			s = addEnv(k, m[k])(s)
+		}
+		return s
+	}
+}
+
+// WithEnvFile reads a "KEY=VALUE" per line env file (blank lines and lines
+// starting with # are ignored, matching common .env conventions) and
+// returns a StateOption that adds its contents to the state's environment.
+// The file is read immediately so a missing or malformed file is reported
+// to the caller instead of surfacing much later at marshal time.
+func WithEnvFile(path string) (StateOption, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open env file %s", path)
+	}
+	defer f.Close()
+
+	env := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid line in env file %s: %q", path, line)
+		}
+		env[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read env file %s", path)
+	}
+
+	return AddEnvFromMap(env), nil
+}
+
 func dir(str string) StateOption {
 	return dirf(str)
 }
@@ -50,6 +107,13 @@ func reset(s_ State) StateOption {
 	}
 }
 
+// GetEnv returns s's environment list. It is the exported form of getEnv
+// for frontends that need to introspect a State without reaching into its
+// unexported context keys.
+func GetEnv(s State) EnvList {
+	return getEnv(s)
+}
+
 func getEnv(s State) EnvList {
 	v := s.Value(keyEnv)
 	if v != nil {
@@ -58,6 +122,11 @@ func getEnv(s State) EnvList {
 	return EnvList{}
 }
 
+// GetDir returns s's working directory. It is the exported form of getDir.
+func GetDir(s State) string {
+	return getDir(s)
+}
+
 func getDir(s State) string {
 	v := s.Value(keyDir)
 	if v != nil {
@@ -66,6 +135,12 @@ func getDir(s State) string {
 	return ""
 }
 
+// GetArgs returns s's command arguments. It is the exported form of
+// getArgs.
+func GetArgs(s State) []string {
+	return getArgs(s)
+}
+
 func getArgs(s State) []string {
 	v := s.Value(keyArgs)
 	if v != nil {
@@ -80,14 +155,46 @@ func args(args ...string) StateOption {
 	}
 }
 
+// WithArgsSlice returns a StateOption that sets the command's arguments to
+// argv verbatim, for callers that already have a parsed argument list and
+// don't want it round-tripped through shell quoting/splitting.
+func WithArgsSlice(argv []string) StateOption {
+	return args(argv...)
+}
+
+// Argsf is the typed, error-returning counterpart of args/WithArgsSlice: it
+// validates argv before building the StateOption instead of silently
+// accepting (and later failing on) an empty command.
+func Argsf(argv ...string) (StateOption, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("argsf: at least one argument is required")
+	}
+	return args(argv...), nil
+}
+
 func shlexf(str string, v ...interface{}) StateOption {
-	return func(s State) State {
-		arg, err := shlex.Split(fmt.Sprintf(str, v...))
-		if err != nil {
-			// TODO: handle error
-		}
-		return args(arg...)(s)
+	so, err := Shlexf(str, v...)
+	if err != nil {
+		// Preserved for callers that haven't migrated to Shlexf yet: a
+		// malformed RUN string now at least produces an empty argv
+		// instead of panicking, same as before this was made visible to
+		// callers that do check the error.
+		return args()
+	}
+	return so
+}
+
+// Shlexf formats str with v and splits the result the way a shell would,
+// returning an error instead of silently swallowing one when the format
+// string can't be tokenized (eg. unbalanced quotes) -- previously this was
+// a `// TODO: handle error` in shlexf, which left a malformed RUN string
+// producing a confusing empty-argv failure several steps downstream.
+func Shlexf(str string, v ...interface{}) (StateOption, error) {
+	arg, err := shlex.Split(fmt.Sprintf(str, v...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %q", str)
 	}
+	return args(arg...), nil
 }
 
 type EnvList []KeyValue
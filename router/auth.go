@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Identity is what the router resolves a validated (or anonymous) request
+// down to before proxying it upstream. It is forwarded to the function as
+// a signed X-OpenFaaS-Identity header so the function (and any peer
+// cluster it in turn talks to) doesn't have to re-validate the bearer
+// token itself.
+type Identity struct {
+	Subject string   `json:"sub"`
+	Tenant  string   `json:"tenant"`
+	Scopes  []string `json:"scopes,omitempty"`
+	Anon    bool     `json:"anon,omitempty"`
+}
+
+// claims is the subset of a validated OIDC ID/access token this router
+// cares about.
+type claims struct {
+	Subject string `json:"sub"`
+	Tenant  string `json:"tenant"`
+	Exp     int64  `json:"exp"`
+	Nbf     int64  `json:"nbf"`
+	Scope   string `json:"scope"`
+}
+
+func (c claims) scopes() []string {
+	if c.Scope == "" {
+		return nil
+	}
+	return strings.Fields(c.Scope)
+}
+
+// Authenticator validates bearer tokens against a JWKS endpoint. It does
+// not sign the identity header handed upstream; withAuth does that.
+type Authenticator struct {
+	jwks         *jwksClient
+	identityKey  []byte
+	publicRoutes map[string]bool
+}
+
+// NewAuthenticator builds an Authenticator that verifies tokens against
+// jwksURL. identityKey is stored on the Authenticator but not used by it:
+// identities are signed by withAuth with its own identityKey argument. publicRoutes is
+// the set of tenant subdomains that may be accessed without a token (the
+// anonymous-token fallback).
+func NewAuthenticator(jwksURL string, identityKey []byte, publicRoutes map[string]bool) *Authenticator {
+	return &Authenticator{
+		jwks:         newJWKSClient(jwksURL, &http.Client{Timeout: 5 * time.Second}),
+		identityKey:  identityKey,
+		publicRoutes: publicRoutes,
+	}
+}
+
+// Authenticate resolves the Identity for an incoming request to tenant. A
+// missing or invalid token is only tolerated for tenants in publicRoutes,
+// in which case an anonymous Identity is returned. A token that verifies
+// but was issued for a different tenant is rejected outright (even for
+// publicRoutes) rather than falling back to anonymous, since silently
+// downgrading would mask the caller presenting someone else's token.
+func (a *Authenticator) Authenticate(r *http.Request, tenant string) (Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		if a.publicRoutes[tenant] {
+			return Identity{Tenant: tenant, Anon: true}, nil
+		}
+		return Identity{}, fmt.Errorf("missing bearer token")
+	}
+
+	c, err := a.verify(token)
+	if err != nil {
+		if a.publicRoutes[tenant] {
+			return Identity{Tenant: tenant, Anon: true}, nil
+		}
+		return Identity{}, err
+	}
+
+	if c.Tenant != tenant {
+		return Identity{}, fmt.Errorf("token issued for tenant %q, not %q", c.Tenant, tenant)
+	}
+
+	return Identity{Subject: c.Subject, Tenant: tenant, Scopes: c.scopes()}, nil
+}
+
+// withAuth authenticates every request before handing it to next, resolves
+// the tenant's extra reader tokens, and attaches a signed
+// X-OpenFaaS-Identity header plus the reader tokens so the function (and
+// anything it calls in turn) can trust who the caller is without
+// re-validating the original bearer token itself.
+func withAuth(auth *Authenticator, readers ReaderTokenStore, identityKey []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := tenantFromHost(r.Host)
+
+		identity, err := auth.Authenticate(r, tenant)
+		if err != nil {
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		signed, err := signIdentity(identityKey, identity)
+		if err != nil {
+			http.Error(w, "failed to sign identity", http.StatusInternalServerError)
+			return
+		}
+		r.Header.Set("X-OpenFaaS-Identity", signed)
+
+		// Always clear whatever the caller sent here first: this header is
+		// only ever meant to carry tokens the router itself resolved, so a
+		// client-forged value must never reach the function, including on
+		// tenants with no reader-tokens secret provisioned.
+		r.Header.Del("X-OpenFaaS-Reader-Tokens")
+		if tokens, err := readers.ReaderTokens(tenant); err == nil && len(tokens) > 0 {
+			r.Header.Set("X-OpenFaaS-Reader-Tokens", strings.Join(tokens, ","))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return h[len(prefix):]
+	}
+	return ""
+}
+
+// verify checks the JWT's RS256 signature against the JWKS endpoint and
+// its exp/nbf claims. It deliberately does not support "none" or HMAC
+// algorithms so a forged header can never skip signature verification.
+func (a *Authenticator) verify(token string) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims{}, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims{}, fmt.Errorf("decoding token header: %w", err)
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return claims{}, fmt.Errorf("parsing token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return claims{}, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims{}, fmt.Errorf("decoding token signature: %w", err)
+	}
+
+	pub, err := a.jwks.key(header.Kid)
+	if err != nil {
+		return claims{}, fmt.Errorf("resolving signing key: %w", err)
+	}
+
+	signed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, signed[:], sig); err != nil {
+		return claims{}, fmt.Errorf("invalid token signature: %w", err)
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims{}, fmt.Errorf("decoding token payload: %w", err)
+	}
+	var c claims
+	if err := json.Unmarshal(payloadJSON, &c); err != nil {
+		return claims{}, fmt.Errorf("parsing token payload: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if c.Exp != 0 && now >= c.Exp {
+		return claims{}, fmt.Errorf("token expired")
+	}
+	if c.Nbf != 0 && now < c.Nbf {
+		return claims{}, fmt.Errorf("token not yet valid")
+	}
+
+	return c, nil
+}
+
+// signIdentity produces a compact, HMAC-signed representation of identity
+// suitable for the X-OpenFaaS-Identity header: base64url(json) + "." +
+// base64url(hmac-sha256). Downstream functions that share identityKey can
+// verify it came from this router without re-validating the original
+// bearer token.
+func signIdentity(identityKey []byte, identity Identity) (string, error) {
+	payload, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	h := hmac.New(sha256.New, identityKey)
+	h.Write([]byte(encoded))
+	mac := h.Sum(nil)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwk is the subset of RFC 7517 fields this router understands. Only RSA
+// signing keys are supported since that is what every OIDC provider we
+// target (Auth0, Keycloak, Dex) publishes by default.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwksClient fetches and caches the signing keys published at a JWKS
+// endpoint, re-fetching once the cache ages past jwksCacheTTL.
+type jwksClient struct {
+	url        string
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+const jwksCacheTTL = 10 * time.Minute
+
+func newJWKSClient(url string, httpClient *http.Client) *jwksClient {
+	return &jwksClient{url: url, httpClient: httpClient, keys: map[string]*rsa.PublicKey{}}
+}
+
+func (c *jwksClient) key(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	stale := time.Since(c.fetchedAt) > jwksCacheTTL
+	key, ok := c.keys[kid]
+	c.mu.Unlock()
+
+	if ok && !stale {
+		return key, nil
+	}
+
+	if err := c.refresh(); err != nil {
+		if ok {
+			// serve the stale key rather than fail a request outright
+			// because the IdP endpoint had a blip.
+			return key, nil
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok = c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no jwks key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+func (c *jwksClient) refresh() error {
+	res, err := c.httpClient.Get(c.url)
+	if err != nil {
+		return fmt.Errorf("fetching jwks: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching jwks: upstream returned %d", res.StatusCode)
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decoding jwks: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		pub, err := rsaPublicKeyFromJWK(k)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+func rsaPublicKeyFromJWK(k jwk) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
+	"encoding/json"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 func main() {
 	port := "8080"
-
 	if portVal, exists := os.LookupEnv("port"); exists && len(portVal) > 0 {
 		port = portVal
 	}
@@ -30,71 +31,214 @@ func main() {
 		log.Panicln("give an upstream_url as an env-var")
 	}
 
-	c := &http.Client{}
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil {
+		log.Panicln("upstream_url is not a valid URL: ", err)
+	}
+
+	proxy := makeProxy(upstream)
+
 	router := http.NewServeMux()
-	router.HandleFunc("/", makeHandler(c, upstreamURL))
+	router.HandleFunc("/healthz", handleHealthz)
+
+	if jwksURL, exists := os.LookupEnv("oidc_jwks_url"); exists && len(jwksURL) > 0 {
+		identityKey := []byte(os.Getenv("identity_signing_key"))
+		if len(identityKey) == 0 {
+			log.Panicln("identity_signing_key must be set when oidc_jwks_url is configured")
+		}
+
+		auth := NewAuthenticator(jwksURL, identityKey, publicRoutesEnv("public_routes"))
+		readers := NewFileReaderTokenStore(stringEnv("secret_mount_path", "/var/openfaas/secrets"))
+
+		router.HandleFunc("/authz-debug", handleAuthzDebug(auth))
+		router.Handle("/", withAuth(auth, readers, identityKey, proxy))
+	} else {
+		router.Handle("/", proxy)
+	}
 
 	s := &http.Server{
 		Addr:           ":" + port,
 		Handler:        router,
-		ReadTimeout:    60 * time.Second,
-		WriteTimeout:   60 * time.Second,
+		ReadTimeout:    durationEnv("read_timeout", 60*time.Second),
+		WriteTimeout:   durationEnv("write_timeout", 60*time.Second),
 		MaxHeaderBytes: 1 << 20,
 	}
 
 	log.Fatal(s.ListenAndServe())
 }
 
-func makeHandler(c *http.Client, upstreamURL string) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
 
-		if len(r.Host) == 0 {
-			w.WriteHeader(http.StatusBadRequest)
-		}
+// hopHeaders are the header fields that, per RFC 7230 section 6.1, are
+// meaningful only for a single transport-level connection and must not be
+// forwarded by a proxy. Connection and Upgrade are handled separately since
+// an HTTP/1.1 Upgrade (eg. WebSocket) needs them left in place.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
-		requestURI := r.RequestURI
-		if strings.HasPrefix(requestURI, "/") {
-			requestURI = requestURI[1:]
-		}
+// makeProxy builds an httputil.ReverseProxy that rewrites the incoming
+// subdomain (eg. user.example.com) to the matching function route on
+// upstream (upstream/function/user-<path>), the way the edge router has
+// always addressed functions, but streams both the request and response
+// body instead of buffering them and forwards WebSocket/SSE traffic
+// untouched.
+func makeProxy(upstream *url.URL) *httputil.ReverseProxy {
+	director := func(req *http.Request) {
+		originalHost := req.Host
+		tenant := tenantFromHost(originalHost)
+
+		requestPath := strings.TrimPrefix(req.URL.Path, "/")
+
+		req.URL.Scheme = upstream.Scheme
+		req.URL.Host = upstream.Host
+		req.URL.Path = singleJoiningSlash(upstream.Path, "function/"+tenant+"-"+requestPath)
+		req.URL.RawPath = ""
+		req.Host = upstream.Host
+
+		// X-Forwarded-For is left to httputil.ReverseProxy itself: when
+		// Director (rather than Rewrite) is set it already appends
+		// RemoteAddr to any prior value, so folding it here too would
+		// double up the client's hop.
+		req.Header.Set("X-Forwarded-Host", originalHost)
+		req.Header.Set("X-Forwarded-Proto", forwardedProto(req))
+
+		removeHopHeaders(req.Header, isUpgrade(req.Header))
+	}
 
-		path := fmt.Sprintf("%sfunction/%s-%s", upstreamURL, r.Host[0:strings.Index(r.Host, ".")], requestURI)
+	modifyResponse := func(res *http.Response) error {
+		removeHopHeaders(res.Header, isUpgrade(res.Header))
+		res.Header.Set("Via", "1.1 openfaas-cloud-router")
+		return nil
+	}
 
-		fmt.Println("Proxying to: ", path)
+	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("upstream error for %s: %v", r.URL, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
 
-		if r.Body != nil {
-			defer r.Body.Close()
-		}
-		req, _ := http.NewRequest(r.Method, path, r.Body)
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          intEnv("max_idle_conns", 100),
+		MaxIdleConnsPerHost:   intEnv("max_idle_conns", 100),
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: durationEnv("upstream_timeout", 30*time.Second),
+	}
 
-		copyHeaders(req.Header, &r.Header)
+	return &httputil.ReverseProxy{
+		Director:       director,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		Transport:      transport,
+		FlushInterval:  durationEnv("flush_interval", 100*time.Millisecond),
+	}
+}
+
+// tenantFromHost returns the subdomain a request was addressed to (eg.
+// "user" for user.example.com), which doubles as the function-name prefix
+// and the tenant identity is resolved for.
+func tenantFromHost(host string) string {
+	if idx := strings.Index(host, "."); idx > 0 {
+		return host[:idx]
+	}
+	return host
+}
 
-		res, resErr := c.Do(req)
-		if resErr != nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(resErr.Error()))
+func handleAuthzDebug(auth *Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := tenantFromHost(r.Host)
 
-			fmt.Printf("Upstream %s status: %d", path, http.StatusBadGateway)
+		identity, err := auth.Authenticate(r, tenant)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		copyHeaders(w.Header(), &res.Header)
-		fmt.Printf("Upstream %s status: %d", path, res.StatusCode)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(identity)
+	}
+}
 
-		w.WriteHeader(res.StatusCode)
-		if res.Body != nil {
-			defer res.Body.Close()
+func stringEnv(key, fallback string) string {
+	if v, exists := os.LookupEnv(key); exists && len(v) > 0 {
+		return v
+	}
+	return fallback
+}
 
-			bytesOut, _ := ioutil.ReadAll(res.Body)
-			w.Write(bytesOut)
+func publicRoutesEnv(key string) map[string]bool {
+	routes := map[string]bool{}
+	v, exists := os.LookupEnv(key)
+	if !exists {
+		return routes
+	}
+	for _, r := range strings.Split(v, ",") {
+		r = strings.TrimSpace(r)
+		if r != "" {
+			routes[r] = true
 		}
+	}
+	return routes
+}
 
+func isUpgrade(h http.Header) bool {
+	return strings.EqualFold(h.Get("Connection"), "upgrade") && h.Get("Upgrade") != ""
+}
+
+func removeHopHeaders(h http.Header, keepUpgrade bool) {
+	for _, name := range hopHeaders {
+		if keepUpgrade && (name == "Connection" || name == "Upgrade") {
+			continue
+		}
+		h.Del(name)
 	}
 }
 
-func copyHeaders(destination http.Header, source *http.Header) {
-	for k, v := range *source {
-		vClone := make([]string, len(v))
-		copy(vClone, v)
-		(destination)[k] = vClone
+func forwardedProto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+func durationEnv(key string, fallback time.Duration) time.Duration {
+	if v, exists := os.LookupEnv(key); exists && len(v) > 0 {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Printf("invalid duration for %s=%q, using default %s", key, v, fallback)
+	}
+	return fallback
+}
+
+func intEnv(key string, fallback int) int {
+	if v, exists := os.LookupEnv(key); exists && len(v) > 0 {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("invalid integer for %s=%q, using default %d", key, v, fallback)
 	}
+	return fallback
 }
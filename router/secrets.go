@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ReaderTokenStore resolves the extra, per-tenant "reader" tokens that get
+// forwarded alongside a request's primary token so an upstream function
+// can in turn authenticate against peer clusters on the caller's behalf -
+// the same federated-token pattern used by Arvados' workbench.
+type ReaderTokenStore interface {
+	ReaderTokens(tenant string) ([]string, error)
+}
+
+// fileReaderTokenStore reads reader tokens from a secrets directory mounted
+// into the router's container, one file per tenant named
+// "reader-tokens-<tenant>", newline-separated. This mirrors how OpenFaaS
+// itself mounts function secrets, so operators can manage these the same
+// way as any other OpenFaaS secret.
+type fileReaderTokenStore struct {
+	dir string
+}
+
+// NewFileReaderTokenStore returns a ReaderTokenStore backed by dir.
+func NewFileReaderTokenStore(dir string) ReaderTokenStore {
+	return &fileReaderTokenStore{dir: dir}
+}
+
+func (s *fileReaderTokenStore) ReaderTokens(tenant string) ([]string, error) {
+	path := filepath.Join(s.dir, "reader-tokens-"+tenant)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		// No secret provisioned for this tenant is the common case, not
+		// an error: it just means nothing gets forwarded beyond the
+		// primary token.
+		return nil, nil
+	}
+
+	var tokens []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, nil
+}